@@ -0,0 +1,31 @@
+package ps
+
+import (
+	"hash/fnv"
+)
+
+// Every map is a tree with at most this many children per node.  Each
+// level of the tree consumes shiftSize bits of the key's hash to choose
+// which child to descend into.
+const childCount = 8
+const shiftSize = 3
+
+// hashFunc computes a key's hash.  It's a package variable rather than
+// a hard-coded call so tests can substitute a hash that deliberately
+// collides, exercising the bucket-chaining path that real 64-bit
+// collisions only hit by chance.
+var hashFunc = fnv64aHash
+
+// hashKey computes a 64-bit hash for a string key.  The hash is used to
+// decide a key's position in the tree; two different keys landing on
+// the same hash share a node's bucket rather than being treated as an
+// error.
+func hashKey(key string) uint64 {
+	return hashFunc(key)
+}
+
+func fnv64aHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
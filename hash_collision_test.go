@@ -0,0 +1,120 @@
+package ps
+
+import "testing"
+
+// withHashFunc replaces hashFunc for the duration of the calling test,
+// letting a test force deliberate collisions that real 64-bit hashes
+// only hit by chance.
+func withHashFunc(t *testing.T, f func(string) uint64) {
+	t.Helper()
+	orig := hashFunc
+	hashFunc = f
+	t.Cleanup(func() { hashFunc = orig })
+}
+
+func constantHash(string) uint64 { return 42 }
+
+func TestMapCollisionSetLookupDelete(t *testing.T) {
+	withHashFunc(t, constantHash)
+
+	m := NewMap().Set("a", 1).(*tree).Set("b", 2).(*tree).Set("c", 3).(*tree)
+	if m.Size() != 3 {
+		t.Fatalf("Size() = %d, want 3", m.Size())
+	}
+	for k, want := range map[string]int{"a": 1, "b": 2, "c": 3} {
+		got, ok := m.Lookup(k)
+		if !ok || got != want {
+			t.Errorf("Lookup(%q) = %v, %v; want %d, true", k, got, ok, want)
+		}
+	}
+
+	updated := m.Set("b", 20).(*tree)
+	if v, _ := updated.Lookup("b"); v != 20 {
+		t.Fatalf("updated b = %v, want 20", v)
+	}
+	if v, _ := m.Lookup("b"); v != 2 {
+		t.Fatalf("original map was mutated: b = %v, want 2", v)
+	}
+
+	afterDelete := updated.Delete("a").(*tree)
+	if afterDelete.Size() != 2 {
+		t.Fatalf("Size() after delete = %d, want 2", afterDelete.Size())
+	}
+	if _, ok := afterDelete.Lookup("a"); ok {
+		t.Fatalf("a should have been deleted")
+	}
+	if v, ok := afterDelete.Lookup("b"); !ok || v != 20 {
+		t.Fatalf("b after delete = %v, %v; want 20, true", v, ok)
+	}
+	if v, ok := afterDelete.Lookup("c"); !ok || v != 3 {
+		t.Fatalf("c after delete = %v, %v; want 3, true", v, ok)
+	}
+
+	empty := afterDelete.Delete("b").(*tree).Delete("c").(*tree)
+	if !empty.IsNil() {
+		t.Fatalf("expected empty map after deleting every colliding key, got size %d", empty.Size())
+	}
+}
+
+func TestMapCollisionForEachAndKeys(t *testing.T) {
+	withHashFunc(t, constantHash)
+
+	m := NewMap().Set("a", 1).(*tree).Set("b", 2).(*tree).Set("c", 3).(*tree)
+	seen := map[string]int{}
+	m.ForEach(func(k string, v Any) { seen[k] = v.(int) })
+	if len(seen) != 3 || seen["a"] != 1 || seen["b"] != 2 || seen["c"] != 3 {
+		t.Fatalf("ForEach saw %v, want {a:1 b:2 c:3}", seen)
+	}
+	if len(m.Keys()) != 3 {
+		t.Fatalf("Keys() len = %d, want 3", len(m.Keys()))
+	}
+}
+
+// TestMapCollisionDeletePromotesWholeBucket forces a colliding bucket
+// to live under the root as one of its children, then deletes the
+// root's own key.  The replacement promoted up from that child must
+// bring its whole bucket along: a colliding node's entries all share
+// one hash, so splitting them across a parent/child pair would make
+// part of the bucket unreachable (lookup stops descending the moment a
+// node's hash matches).
+func TestMapCollisionDeletePromotesWholeBucket(t *testing.T) {
+	withHashFunc(t, func(key string) uint64 {
+		if key == "r" {
+			return 0
+		}
+		return 1
+	})
+
+	m := NewMap().Set("r", 0).(*tree).Set("a0", 1).(*tree).Set("a1", 2).(*tree).Set("a2", 3).(*tree)
+
+	afterDelete := m.Delete("r").(*tree)
+	if afterDelete.Size() != 3 {
+		t.Fatalf("Size() after delete = %d, want 3", afterDelete.Size())
+	}
+	if _, ok := afterDelete.Lookup("r"); ok {
+		t.Fatalf("r should have been deleted")
+	}
+	for k, want := range map[string]int{"a0": 1, "a1": 2, "a2": 3} {
+		got, ok := afterDelete.Lookup(k)
+		if !ok || got != want {
+			t.Fatalf("Lookup(%q) = %v, %v; want %d, true", k, got, ok, want)
+		}
+	}
+}
+
+func TestStringMapCollisionSetLookupDelete(t *testing.T) {
+	withHashFunc(t, constantHash)
+
+	m := NewStringMap().Set("a", "1").(*StringMap).Set("b", "2").(*StringMap)
+	if v, ok := m.Lookup("a"); !ok || v != "1" {
+		t.Fatalf("a = %q, %v; want 1, true", v, ok)
+	}
+
+	afterDelete := m.Delete("a").(*StringMap)
+	if _, ok := afterDelete.Lookup("a"); ok {
+		t.Fatalf("a should have been deleted")
+	}
+	if v, ok := afterDelete.Lookup("b"); !ok || v != "2" {
+		t.Fatalf("b = %q, %v; want 2, true", v, ok)
+	}
+}
@@ -0,0 +1,349 @@
+package ps
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Any is the type of values stored in a Map.
+type Any interface{}
+
+// Map is the common, value-type-agnostic surface shared by every
+// persistent map this package offers (the generic *tree behind NewMap,
+// *StringMap, and RadixMap).  Callers who need Set/Delete/Lookup work
+// against the concrete type returned by that type's constructor; Map
+// exists so code that merely inspects a map (size, emptiness, debug
+// printing) doesn't need to care which one it was given.
+type Map interface {
+	IsNil() bool
+
+	// Size returns the number of key/value pairs in the map.
+	Size() int
+
+	String() string
+}
+
+// entry is one extra key/value pair chained onto a node whose hash
+// collides with the node's own key.  Collisions between distinct keys
+// are rare with a good hash, so they're kept out of the common,
+// single-entry node shape and only paid for when they actually occur.
+type entry struct {
+	key   string
+	value Any
+}
+
+type tree struct {
+	count    int
+	hash     uint64 // hash of the key (used for tree balancing)
+	key      string
+	value    Any
+	extra    []entry // additional key/value pairs that hash-collide with key; nil in the common case
+	children [childCount]*tree
+	mutateCh chan struct{} // lazily created; closed when a Txn replaces this node
+}
+
+var nilMap = &tree{}
+
+// Recursively set nilMap's subtrees to point at itself.
+// This eliminates all nil pointers in the map structure.
+// All map nodes are created by cloning this structure so
+// they avoid the problem too.
+func init() {
+	for i := range nilMap.children {
+		nilMap.children[i] = nilMap
+	}
+}
+
+// NewMap allocates a new, persistent map from strings to values of
+// any type.
+// This is currently implemented as a path-copying tree with childCount
+// children per node.
+func NewMap() *tree {
+	return nilMap
+}
+
+func (self *tree) IsNil() bool {
+	return self == nilMap
+}
+
+// clone returns an exact duplicate of a tree node, except for mutateCh:
+// the clone is a logically distinct node, so it starts with no watchers
+// of its own (self's watchers are notified separately when its mutateCh
+// is closed). mutateCh is deliberately left out of a wholesale struct
+// copy rather than copied-then-zeroed, since self may be a published
+// node whose mutateCh is concurrently closed by a Commit on another
+// Txn; reading it here without going through chMu would race.
+func (self *tree) clone() *tree {
+	return &tree{
+		count:    self.count,
+		hash:     self.hash,
+		key:      self.key,
+		value:    self.value,
+		extra:    self.extra,
+		children: self.children,
+	}
+}
+
+// Set returns a new map similar to this one but with key and value
+// associated.  If the key didn't exist, it's created; otherwise, the
+// associated value is changed.
+func (self *tree) Set(key string, value Any) Map {
+	hash := hashKey(key)
+	return self.setLowLevel(nil, hash, hash, key, value)
+}
+
+func (self *tree) setLowLevel(txn *txnCache, partialHash, hash uint64, key string, value Any) *tree {
+	if self.IsNil() { // an empty tree is easy
+		m := txn.cloneOf(self)
+		m.count = 1
+		m.hash = hash
+		m.key = key
+		m.value = value
+		return m
+	}
+
+	if hash != self.hash {
+		m := txn.cloneOf(self)
+		i := partialHash % childCount
+		m.children[i] = m.children[i].setLowLevel(txn, partialHash>>shiftSize, hash, key, value)
+		m.recalculateCount()
+		return m
+	}
+
+	// same hash: either replacing this node's own key...
+	if key == self.key {
+		m := txn.cloneOf(self)
+		m.value = value
+		return m
+	}
+
+	// ...or an existing member of its collision bucket...
+	for i, e := range self.extra {
+		if e.key == key {
+			m := txn.cloneOf(self)
+			newExtra := make([]entry, len(m.extra))
+			copy(newExtra, m.extra)
+			newExtra[i].value = value
+			m.extra = newExtra
+			return m
+		}
+	}
+
+	// ...or a genuine collision: a new key sharing this node's hash.
+	m := txn.cloneOf(self)
+	newExtra := make([]entry, len(m.extra)+1)
+	copy(newExtra, m.extra)
+	newExtra[len(m.extra)] = entry{key, value}
+	m.extra = newExtra
+	m.count++
+	return m
+}
+
+// bucketSize returns the number of keys stored at this node itself
+// (its own key plus any collision-bucket entries), as opposed to keys
+// held by its children.
+func (m *tree) bucketSize() int {
+	return 1 + len(m.extra)
+}
+
+// modifies a map by recalculating its key count based on the counts
+// of its subtrees
+func (m *tree) recalculateCount() {
+	count := 0
+	for _, t := range m.children {
+		count += t.Size()
+	}
+	m.count = count + m.bucketSize()
+}
+
+func (m *tree) Delete(key string) Map {
+	hash := hashKey(key)
+	newMap, _ := m.deleteLowLevel(nil, hash, hash, key)
+	return newMap
+}
+
+func (self *tree) deleteLowLevel(txn *txnCache, partialHash, hash uint64, key string) (*tree, bool) {
+	// empty trees are easy
+	if self.IsNil() {
+		return self, false
+	}
+
+	if hash != self.hash {
+		i := partialHash % childCount
+		child, found := self.children[i].deleteLowLevel(txn, partialHash>>shiftSize, hash, key)
+		if !found {
+			return self, false
+		}
+		newMap := txn.cloneOf(self)
+		newMap.children[i] = child
+		newMap.recalculateCount()
+		return newMap, true
+	}
+
+	// same hash, but not our own key: look for it in the bucket
+	if key != self.key {
+		for i, e := range self.extra {
+			if e.key == key {
+				newMap := txn.cloneOf(self)
+				newExtra := make([]entry, 0, len(self.extra)-1)
+				newExtra = append(newExtra, self.extra[:i]...)
+				newExtra = append(newExtra, self.extra[i+1:]...)
+				newMap.extra = newExtra
+				newMap.recalculateCount()
+				return newMap, true
+			}
+		}
+		return self, false
+	}
+
+	// deleting our own key: if the bucket has other members, the
+	// first of them takes over as this node's own key
+	if len(self.extra) > 0 {
+		newMap := txn.cloneOf(self)
+		newMap.key = self.extra[0].key
+		newMap.value = self.extra[0].value
+		newMap.extra = append([]entry(nil), self.extra[1:]...)
+		newMap.recalculateCount()
+		return newMap, true
+	}
+
+	// we must delete our own node
+	if self.isLeaf() { // we have no children
+		return nilMap, true
+	}
+
+	// find a node to replace us
+	i := -1
+	size := -1
+	for j, t := range self.children {
+		if t.Size() > size {
+			i = j
+			size = t.Size()
+		}
+	}
+
+	// make chosen leaf smaller
+	replacement, child := self.children[i].deleteLeftmost(txn)
+	newMap := txn.cloneOf(replacement)
+	for j := range self.children {
+		if j == i {
+			newMap.children[j] = child
+		} else {
+			newMap.children[j] = self.children[j]
+		}
+	}
+	newMap.recalculateCount()
+	return newMap, true
+}
+
+// delete the leftmost node in a tree returning the node that
+// was deleted and the tree left over after its deletion
+func (m *tree) deleteLeftmost(txn *txnCache) (*tree, *tree) {
+	if m.isLeaf() {
+		// A leaf's whole bucket - its own key plus any collision-chain
+		// entries - shares one hash, so it moves as a single unit; it
+		// can't be split between the promoted node and what's left
+		// behind without making part of it unreachable.
+		return m, nilMap
+	}
+
+	for i, t := range m.children {
+		if t != nilMap {
+			deleted, child := t.deleteLeftmost(txn)
+			newMap := txn.cloneOf(m)
+			newMap.children[i] = child
+			newMap.recalculateCount()
+			return deleted, newMap
+		}
+	}
+	panic("Tree isn't a leaf but also had no children. How does that happen?")
+}
+
+// isLeaf returns true if this is a leaf node
+func (m *tree) isLeaf() bool {
+	return m.subtreeCount() == 0
+}
+
+// returns the number of child subtrees we have
+func (m *tree) subtreeCount() int {
+	count := 0
+	for _, t := range m.children {
+		if t != nilMap {
+			count++
+		}
+	}
+	return count
+}
+
+func (m *tree) Lookup(key string) (Any, bool) {
+	hash := hashKey(key)
+	return m.lookupLowLevel(hash, hash, key)
+}
+
+func (self *tree) lookupLowLevel(partialHash, hash uint64, key string) (Any, bool) {
+	if self.IsNil() { // an empty tree is easy
+		return nil, false
+	}
+
+	if hash != self.hash {
+		i := partialHash % childCount
+		return self.children[i].lookupLowLevel(partialHash>>shiftSize, hash, key)
+	}
+
+	// we found the right node; it may still take a bucket scan to find
+	// the right key
+	if key == self.key {
+		return self.value, true
+	}
+	for _, e := range self.extra {
+		if e.key == key {
+			return e.value, true
+		}
+	}
+	return nil, false
+}
+
+func (m *tree) Size() int {
+	return m.count
+}
+
+func (m *tree) ForEach(f func(key string, val Any)) {
+	if m.IsNil() {
+		return
+	}
+
+	// ourself
+	f(m.key, m.value)
+	for _, e := range m.extra {
+		f(e.key, e.value)
+	}
+
+	// children
+	for _, t := range m.children {
+		if t != nilMap {
+			t.ForEach(f)
+		}
+	}
+}
+
+func (m *tree) Keys() []string {
+	keys := make([]string, m.Size())
+	i := 0
+	m.ForEach(func(k string, v Any) {
+		keys[i] = k
+		i++
+	})
+	return keys
+}
+
+// make it easier to display maps for debugging
+func (m *tree) String() string {
+	keys := m.Keys()
+	buf := bytes.NewBufferString("{")
+	for _, key := range keys {
+		val, _ := m.Lookup(key)
+		fmt.Fprintf(buf, "%s: %v, ", key, val)
+	}
+	fmt.Fprintf(buf, "}\n")
+	return buf.String()
+}
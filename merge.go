@@ -0,0 +1,371 @@
+package ps
+
+// Union returns a new map containing every key from both self and
+// other.  When both maps have a key, resolve picks the value to keep;
+// resolve may be nil, in which case self's value wins.
+//
+// Structural sharing keeps this close to O(differences) rather than
+// O(n) when self and other share history: unaffected subtrees of self
+// are reused untouched, and a shared subtree reached from both sides
+// (recognized by pointer equality) is skipped without being walked.
+func (self *tree) Union(other Map, resolve func(key string, a, b Any) Any) Map {
+	otherTree := other.(*tree)
+	switch {
+	case self.IsNil():
+		return otherTree
+	case otherTree.IsNil():
+		return self
+	case self == otherTree:
+		return self
+	}
+	return foldTreeInto(self, self, otherTree, resolve)
+}
+
+// foldTreeInto adds every key/value pair reachable from src into acc,
+// resolving collisions with resolve (or keeping acc's existing value
+// when resolve is nil), and returns the result.  selfSide tracks the
+// node self originally held at src's position; when self and other
+// share history, src eventually turns out to be that very node, and
+// its whole subtree - already part of acc - is skipped without being
+// walked.
+func foldTreeInto(acc, selfSide, src *tree, resolve func(key string, a, b Any) Any) *tree {
+	if src.IsNil() || src == selfSide {
+		return acc
+	}
+
+	acc = mergeEntryInto(acc, src.key, src.value, resolve)
+	for _, e := range src.extra {
+		acc = mergeEntryInto(acc, e.key, e.value, resolve)
+	}
+
+	for i, child := range src.children {
+		acc = foldTreeInto(acc, selfSide.children[i], child, resolve)
+	}
+	return acc
+}
+
+// mergeEntryInto adds key/value into acc, resolving a collision with an
+// existing value via resolve (or keeping acc's existing value when
+// resolve is nil), and returns the result.  When resolve is nil and the
+// key is already present, acc is returned untouched rather than
+// re-Setting the value it already holds: that keeps an unaffected
+// subtree pointer-identical to its source, so later operations relying
+// on pointer equality (another Union, an Intersect) can still skip it.
+func mergeEntryInto(acc *tree, key string, value Any, resolve func(key string, a, b Any) Any) *tree {
+	existing, found := acc.Lookup(key)
+	if !found {
+		return acc.Set(key, value).(*tree)
+	}
+	if resolve == nil {
+		return acc
+	}
+	return acc.Set(key, resolve(key, existing, value)).(*tree)
+}
+
+// Intersect returns a new map containing only the keys present in both
+// self and other, with values taken from self.
+func (self *tree) Intersect(other Map) Map {
+	otherTree := other.(*tree)
+	switch {
+	case self.IsNil() || otherTree.IsNil():
+		return nilMap
+	case self == otherTree:
+		return self
+	}
+	return copySharedInto(nilMap, self, otherTree, otherTree)
+}
+
+// copySharedInto adds every key/value pair reachable from src that is
+// also present in other into acc, and returns the result.  otherSide
+// tracks the node other held at src's position; when self and other
+// share history, src eventually turns out to be that very node, and
+// its whole subtree - known to exist identically in other - is copied
+// in without individual membership checks.
+func copySharedInto(acc, src, otherSide, other *tree) *tree {
+	if src.IsNil() {
+		return acc
+	}
+	if src == otherSide {
+		return copyAllInto(acc, src)
+	}
+
+	if memberOfOtherTree(src, otherSide, other, src.key) {
+		acc = acc.Set(src.key, src.value).(*tree)
+	}
+	for _, e := range src.extra {
+		if memberOfOtherTree(src, otherSide, other, e.key) {
+			acc = acc.Set(e.key, e.value).(*tree)
+		}
+	}
+
+	for i, child := range src.children {
+		acc = copySharedInto(acc, child, otherSide.children[i], other)
+	}
+	return acc
+}
+
+// memberOfOtherTree reports whether key - known to hash to src.hash - is
+// present in other.  Every key sharing a hash lives in exactly one
+// node's bucket, so if otherSide's hash happens to match, otherSide is
+// necessarily that node for the whole of other, not just the position
+// src's traversal arrived at; its bucket can be scanned directly instead
+// of redoing a root-to-leaf Lookup.
+func memberOfOtherTree(src, otherSide, other *tree, key string) bool {
+	if !otherSide.IsNil() && otherSide.hash == src.hash {
+		if otherSide.key == key {
+			return true
+		}
+		for _, e := range otherSide.extra {
+			if e.key == key {
+				return true
+			}
+		}
+		return false
+	}
+	_, found := other.Lookup(key)
+	return found
+}
+
+// copyAllInto unconditionally adds every key/value pair reachable from
+// src into acc, and returns the result.
+func copyAllInto(acc, src *tree) *tree {
+	if src.IsNil() {
+		return acc
+	}
+	acc = acc.Set(src.key, src.value).(*tree)
+	for _, e := range src.extra {
+		acc = acc.Set(e.key, e.value).(*tree)
+	}
+	for _, child := range src.children {
+		acc = copyAllInto(acc, child)
+	}
+	return acc
+}
+
+// Difference returns a new map containing the keys present in self but
+// not in other.
+func (self *tree) Difference(other Map) Map {
+	otherTree := other.(*tree)
+	switch {
+	case self.IsNil():
+		return nilMap
+	case otherTree.IsNil():
+		return self
+	case self == otherTree:
+		return nilMap
+	}
+	return copyAbsentInto(nilMap, self, otherTree, otherTree)
+}
+
+// copyAbsentInto adds every key/value pair reachable from src that is
+// absent from other into acc, and returns the result.  otherSide
+// tracks the node other held at src's position; when self and other
+// share history, src eventually turns out to be that very node, and
+// its whole subtree - known to also exist in other - is skipped
+// without being walked.
+func copyAbsentInto(acc, src, otherSide, other *tree) *tree {
+	if src.IsNil() || src == otherSide {
+		return acc
+	}
+
+	if !memberOfOtherTree(src, otherSide, other, src.key) {
+		acc = acc.Set(src.key, src.value).(*tree)
+	}
+	for _, e := range src.extra {
+		if !memberOfOtherTree(src, otherSide, other, e.key) {
+			acc = acc.Set(e.key, e.value).(*tree)
+		}
+	}
+
+	for i, child := range src.children {
+		acc = copyAbsentInto(acc, child, otherSide.children[i], other)
+	}
+	return acc
+}
+
+// Union returns a new map containing every key from both self and
+// other.  When both maps have a key, resolve picks the value to keep;
+// resolve may be nil, in which case self's value wins.
+//
+// Structural sharing keeps this close to O(differences) rather than
+// O(n) when self and other share history: unaffected subtrees of self
+// are reused untouched, and a shared subtree reached from both sides
+// (recognized by pointer equality) is skipped without being walked.
+func (self *StringMap) Union(other Map, resolve func(key string, a, b string) string) Map {
+	otherMap := other.(*StringMap)
+	switch {
+	case self.IsNil():
+		return otherMap
+	case otherMap.IsNil():
+		return self
+	case self == otherMap:
+		return self
+	}
+	return foldStringMapInto(self, self, otherMap, resolve)
+}
+
+// foldStringMapInto adds every key/value pair reachable from src into
+// acc, resolving collisions with resolve (or keeping acc's existing
+// value when resolve is nil), and returns the result.  selfSide tracks
+// the node self originally held at src's position; when self and
+// other share history, src eventually turns out to be that very node,
+// and its whole subtree - already part of acc - is skipped without
+// being walked.
+func foldStringMapInto(acc, selfSide, src *StringMap, resolve func(key string, a, b string) string) *StringMap {
+	if src.IsNil() || src == selfSide {
+		return acc
+	}
+
+	acc = mergeStringEntryInto(acc, src.key, src.value, resolve)
+	for _, e := range src.extra {
+		acc = mergeStringEntryInto(acc, e.key, e.value, resolve)
+	}
+
+	for i, child := range src.children {
+		acc = foldStringMapInto(acc, selfSide.children[i], child, resolve)
+	}
+	return acc
+}
+
+// mergeStringEntryInto adds key/value into acc, resolving a collision
+// with an existing value via resolve (or keeping acc's existing value
+// when resolve is nil), and returns the result.  If the resolved value
+// equals what acc already holds, acc is returned untouched rather than
+// re-Setting it: that keeps an unaffected subtree pointer-identical to
+// its source, so later operations relying on pointer equality (another
+// Union, an Intersect) can still skip it.
+func mergeStringEntryInto(acc *StringMap, key, value string, resolve func(key string, a, b string) string) *StringMap {
+	existing, found := acc.Lookup(key)
+	if !found {
+		return acc.Set(key, value).(*StringMap)
+	}
+	resolved := existing
+	if resolve != nil {
+		resolved = resolve(key, existing, value)
+	}
+	if resolved == existing {
+		return acc
+	}
+	return acc.Set(key, resolved).(*StringMap)
+}
+
+// Intersect returns a new map containing only the keys present in both
+// self and other, with values taken from self.
+func (self *StringMap) Intersect(other Map) Map {
+	otherMap := other.(*StringMap)
+	switch {
+	case self.IsNil() || otherMap.IsNil():
+		return nilStringMap
+	case self == otherMap:
+		return self
+	}
+	return copySharedStringMapInto(nilStringMap, self, otherMap, otherMap)
+}
+
+// copySharedStringMapInto adds every key/value pair reachable from src
+// that is also present in other into acc, and returns the result.
+// otherSide tracks the node other held at src's position; when self
+// and other share history, src eventually turns out to be that very
+// node, and its whole subtree - known to exist identically in other -
+// is copied in without individual membership checks.
+func copySharedStringMapInto(acc, src, otherSide, other *StringMap) *StringMap {
+	if src.IsNil() {
+		return acc
+	}
+	if src == otherSide {
+		return copyAllStringMapInto(acc, src)
+	}
+
+	if memberOfOtherStringMap(src, otherSide, other, src.key) {
+		acc = acc.Set(src.key, src.value).(*StringMap)
+	}
+	for _, e := range src.extra {
+		if memberOfOtherStringMap(src, otherSide, other, e.key) {
+			acc = acc.Set(e.key, e.value).(*StringMap)
+		}
+	}
+
+	for i, child := range src.children {
+		acc = copySharedStringMapInto(acc, child, otherSide.children[i], other)
+	}
+	return acc
+}
+
+// memberOfOtherStringMap reports whether key - known to hash to
+// src.hash - is present in other.  Every key sharing a hash lives in
+// exactly one node's bucket, so if otherSide's hash happens to match,
+// otherSide is necessarily that node for the whole of other, not just
+// the position src's traversal arrived at; its bucket can be scanned
+// directly instead of redoing a root-to-leaf Lookup.
+func memberOfOtherStringMap(src, otherSide, other *StringMap, key string) bool {
+	if !otherSide.IsNil() && otherSide.hash == src.hash {
+		if otherSide.key == key {
+			return true
+		}
+		for _, e := range otherSide.extra {
+			if e.key == key {
+				return true
+			}
+		}
+		return false
+	}
+	_, found := other.Lookup(key)
+	return found
+}
+
+// copyAllStringMapInto unconditionally adds every key/value pair
+// reachable from src into acc, and returns the result.
+func copyAllStringMapInto(acc, src *StringMap) *StringMap {
+	if src.IsNil() {
+		return acc
+	}
+	acc = acc.Set(src.key, src.value).(*StringMap)
+	for _, e := range src.extra {
+		acc = acc.Set(e.key, e.value).(*StringMap)
+	}
+	for _, child := range src.children {
+		acc = copyAllStringMapInto(acc, child)
+	}
+	return acc
+}
+
+// Difference returns a new map containing the keys present in self but
+// not in other.
+func (self *StringMap) Difference(other Map) Map {
+	otherMap := other.(*StringMap)
+	switch {
+	case self.IsNil():
+		return nilStringMap
+	case otherMap.IsNil():
+		return self
+	case self == otherMap:
+		return nilStringMap
+	}
+	return copyAbsentStringMapInto(nilStringMap, self, otherMap, otherMap)
+}
+
+// copyAbsentStringMapInto adds every key/value pair reachable from src
+// that is absent from other into acc, and returns the result.
+// otherSide tracks the node other held at src's position; when self
+// and other share history, src eventually turns out to be that very
+// node, and its whole subtree - known to also exist in other - is
+// skipped without being walked.
+func copyAbsentStringMapInto(acc, src, otherSide, other *StringMap) *StringMap {
+	if src.IsNil() || src == otherSide {
+		return acc
+	}
+
+	if !memberOfOtherStringMap(src, otherSide, other, src.key) {
+		acc = acc.Set(src.key, src.value).(*StringMap)
+	}
+	for _, e := range src.extra {
+		if !memberOfOtherStringMap(src, otherSide, other, e.key) {
+			acc = acc.Set(e.key, e.value).(*StringMap)
+		}
+	}
+
+	for i, child := range src.children {
+		acc = copyAbsentStringMapInto(acc, child, otherSide.children[i], other)
+	}
+	return acc
+}
@@ -0,0 +1,149 @@
+package ps
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestMapUnionSharesHistory(t *testing.T) {
+	base := NewMap().Set("a", 1).(*tree).Set("b", 2).(*tree)
+	derived := base.Set("c", 3).(*tree)
+
+	union := base.Union(derived, nil)
+	if union.Size() != 3 {
+		t.Fatalf("Union size = %d, want 3", union.Size())
+	}
+	for key, want := range map[string]int{"a": 1, "b": 2, "c": 3} {
+		got, ok := union.(*tree).Lookup(key)
+		if !ok || got != want {
+			t.Errorf("Lookup(%q) = %v, %v; want %d, true", key, got, ok, want)
+		}
+	}
+}
+
+func TestMapUnionResolvesConflicts(t *testing.T) {
+	left := NewMap().Set("a", 1).(*tree)
+	right := NewMap().Set("a", 2).(*tree)
+
+	defaultWins := left.Union(right, nil)
+	if got, _ := defaultWins.(*tree).Lookup("a"); got != 1 {
+		t.Fatalf("Union with nil resolve = %v, want self's value 1", got)
+	}
+
+	sumResolve := func(key string, a, b Any) Any { return a.(int) + b.(int) }
+	summed := left.Union(right, sumResolve)
+	if got, _ := summed.(*tree).Lookup("a"); got != 3 {
+		t.Fatalf("Union with resolve = %v, want 3", got)
+	}
+}
+
+func TestMapIntersect(t *testing.T) {
+	left := NewMap().Set("a", 1).(*tree).Set("b", 2).(*tree)
+	right := NewMap().Set("b", 20).(*tree).Set("c", 30).(*tree)
+
+	inter := left.Intersect(right)
+	if inter.Size() != 1 {
+		t.Fatalf("Intersect size = %d, want 1", inter.Size())
+	}
+	if got, ok := inter.(*tree).Lookup("b"); !ok || got != 2 {
+		t.Fatalf("Intersect kept %v, %v; want self's value 2", got, ok)
+	}
+}
+
+func TestMapDifference(t *testing.T) {
+	left := NewMap().Set("a", 1).(*tree).Set("b", 2).(*tree)
+	right := NewMap().Set("b", 20).(*tree)
+
+	diff := left.Difference(right)
+	if diff.Size() != 1 {
+		t.Fatalf("Difference size = %d, want 1", diff.Size())
+	}
+	if _, ok := diff.(*tree).Lookup("a"); !ok {
+		t.Fatalf("Difference should have kept key a")
+	}
+	if _, ok := diff.(*tree).Lookup("b"); ok {
+		t.Fatalf("Difference should have dropped key b")
+	}
+}
+
+func TestStringMapUnionSharesHistory(t *testing.T) {
+	base := NewStringMap().Set("a", "1").(*StringMap).Set("b", "2").(*StringMap)
+	derived := base.Set("c", "3").(*StringMap)
+
+	union := base.Union(derived, nil)
+	if union.Size() != 3 {
+		t.Fatalf("Union size = %d, want 3", union.Size())
+	}
+}
+
+func TestStringMapIntersectAndDifference(t *testing.T) {
+	left := NewStringMap().Set("a", "1").(*StringMap).Set("b", "2").(*StringMap)
+	right := NewStringMap().Set("b", "20").(*StringMap).Set("c", "30").(*StringMap)
+
+	inter := left.Intersect(right)
+	if inter.Size() != 1 {
+		t.Fatalf("Intersect size = %d, want 1", inter.Size())
+	}
+	if got, ok := inter.(*StringMap).Lookup("b"); !ok || got != "2" {
+		t.Fatalf("Intersect kept %q, %v; want self's value 2", got, ok)
+	}
+
+	diff := left.Difference(right)
+	if diff.Size() != 1 {
+		t.Fatalf("Difference size = %d, want 1", diff.Size())
+	}
+	if _, ok := diff.(*StringMap).Lookup("a"); !ok {
+		t.Fatalf("Difference should have kept key a")
+	}
+}
+
+func TestMapUnionIntersectDifferenceWithCollisionBucket(t *testing.T) {
+	withHashFunc(t, constantHash)
+
+	left := NewMap().Set("a", 1).(*tree).Set("b", 2).(*tree)
+	right := NewMap().Set("b", 20).(*tree).Set("c", 3).(*tree)
+
+	union := left.Union(right, nil).(*tree)
+	if union.Size() != 3 {
+		t.Fatalf("Union size = %d, want 3", union.Size())
+	}
+	for key, want := range map[string]int{"a": 1, "b": 2, "c": 3} {
+		got, ok := union.Lookup(key)
+		if !ok || got != want {
+			t.Errorf("Lookup(%q) = %v, %v; want %d, true", key, got, ok, want)
+		}
+	}
+
+	inter := left.Intersect(right).(*tree)
+	if inter.Size() != 1 {
+		t.Fatalf("Intersect size = %d, want 1", inter.Size())
+	}
+	if got, ok := inter.Lookup("b"); !ok || got != 2 {
+		t.Fatalf("Intersect kept %v, %v; want self's value 2", got, ok)
+	}
+
+	diff := left.Difference(right).(*tree)
+	if diff.Size() != 1 {
+		t.Fatalf("Difference size = %d, want 1", diff.Size())
+	}
+	if _, ok := diff.Lookup("a"); !ok {
+		t.Fatalf("Difference should have kept key a")
+	}
+	if _, ok := diff.Lookup("b"); ok {
+		t.Fatalf("Difference should have dropped key b")
+	}
+}
+
+func BenchmarkMapUnionSharedHistory(b *testing.B) {
+	base := NewMap()
+	for i := 0; i < 1000; i++ {
+		key := strconv.Itoa(i)
+		base = base.Set(key, i).(*tree)
+	}
+	derived := base.Set("extra", -1).(*tree)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		base.Union(derived, nil)
+	}
+}
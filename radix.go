@@ -0,0 +1,406 @@
+package ps
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// radixLeaf holds the key/value pair attached to a radixNode, if any.
+// The full key is stored here (rather than reconstructed by
+// concatenating prefixes on the way down) so Get, WalkPrefix and
+// friends can hand it back without rebuilding it.
+type radixLeaf struct {
+	key   string
+	value Any
+}
+
+// radixEdge is a single entry in a node's edge table, keyed by the first
+// byte of the child's prefix.  A node's edges are kept sorted by label
+// so ForEach/WalkPrefix can visit them in lexicographic order without a
+// separate sort step.
+type radixEdge struct {
+	label byte
+	node  *radixNode
+}
+
+type radixNode struct {
+	prefix   []byte
+	leaf     *radixLeaf
+	edges    []radixEdge
+	mutateCh chan struct{} // lazily created; closed when Insert/Delete replaces this node
+}
+
+// clone returns a shallow duplicate of n, for use in place of n in the
+// tree Insert/Delete returns.  The prefix slice and the individual edges
+// are never mutated after creation, so sharing them is safe; only
+// n.edges itself (the slice header) is ever replaced, and always with a
+// freshly allocated slice, so aliasing it here is safe until the
+// clone's own addEdge/replaceEdge/delEdge runs.
+//
+// Unlike Map/StringMap, RadixMap has no Txn to batch mutations behind,
+// so every clone call site here means n itself is being superseded
+// right now - which is exactly when n's watchers should wake. clone
+// closes n's mutateCh accordingly, and - like tree.clone/StringMap.clone
+// - leaves it out of the copy rather than copying then zeroing it, since
+// n may be concurrently watched via watchChan and reading the field
+// without going through chMu would race.
+func (n *radixNode) clone() *radixNode {
+	closeRadixMutateCh(n)
+	return &radixNode{
+		prefix: n.prefix,
+		leaf:   n.leaf,
+		edges:  n.edges,
+	}
+}
+
+func (n *radixNode) getEdge(label byte) (int, bool) {
+	for i := range n.edges {
+		if n.edges[i].label == label {
+			return i, true
+		}
+	}
+	return -1, false
+}
+
+func (n *radixNode) addEdge(e radixEdge) {
+	edges := make([]radixEdge, len(n.edges)+1)
+	i := 0
+	for i < len(n.edges) && n.edges[i].label < e.label {
+		edges[i] = n.edges[i]
+		i++
+	}
+	edges[i] = e
+	copy(edges[i+1:], n.edges[i:])
+	n.edges = edges
+}
+
+func (n *radixNode) replaceEdge(idx int, e radixEdge) {
+	edges := make([]radixEdge, len(n.edges))
+	copy(edges, n.edges)
+	edges[idx] = e
+	n.edges = edges
+}
+
+func (n *radixNode) delEdge(idx int) {
+	edges := make([]radixEdge, len(n.edges)-1)
+	copy(edges, n.edges[:idx])
+	copy(edges[idx:], n.edges[idx+1:])
+	n.edges = edges
+}
+
+// RadixMap is a persistent, byte-string-keyed radix (compressed prefix)
+// tree.  Unlike Map and StringMap, which hash keys into a balanced tree,
+// RadixMap preserves the lexicographic ordering of keys and supports
+// prefix queries. As with the other types, every mutation returns a new
+// RadixMap via path-copy, sharing any subtree it didn't touch.
+type RadixMap struct {
+	root *radixNode
+	size int
+}
+
+// NewRadixMap allocates a new, empty, persistent radix tree.
+func NewRadixMap() *RadixMap {
+	return &RadixMap{root: &radixNode{}}
+}
+
+func (m *RadixMap) IsNil() bool {
+	return m.size == 0
+}
+
+// Len returns the number of key/value pairs in the tree.
+func (m *RadixMap) Len() int {
+	return m.size
+}
+
+// Size returns the number of key/value pairs in the tree, satisfying
+// the Map interface.
+func (m *RadixMap) Size() int {
+	return m.size
+}
+
+// Get returns the value associated with key, or false if there's no
+// such association.
+func (m *RadixMap) Get(key string) (Any, bool) {
+	n := m.root
+	search := []byte(key)
+	for {
+		if len(search) == 0 {
+			if n.leaf != nil {
+				return n.leaf.value, true
+			}
+			return nil, false
+		}
+		idx, ok := n.getEdge(search[0])
+		if !ok || !bytes.HasPrefix(search, n.edges[idx].node.prefix) {
+			return nil, false
+		}
+		n = n.edges[idx].node
+		search = search[len(n.prefix):]
+	}
+}
+
+// Insert returns a new tree similar to this one but with key and value
+// associated.  If the key didn't exist, it's created; otherwise, the
+// associated value is changed.
+func (m *RadixMap) Insert(key string, value Any) *RadixMap {
+	newRoot, updated := insertRadix(m.root, []byte(key), key, value)
+	size := m.size
+	if !updated {
+		size++
+	}
+	return &RadixMap{root: newRoot, size: size}
+}
+
+func insertRadix(n *radixNode, search []byte, key string, value Any) (*radixNode, bool) {
+	if len(search) == 0 {
+		nc := n.clone()
+		updated := nc.leaf != nil
+		nc.leaf = &radixLeaf{key: key, value: value}
+		return nc, updated
+	}
+
+	idx, ok := n.getEdge(search[0])
+	if !ok {
+		nc := n.clone()
+		nc.addEdge(radixEdge{
+			label: search[0],
+			node:  &radixNode{prefix: search, leaf: &radixLeaf{key: key, value: value}},
+		})
+		return nc, false
+	}
+
+	child := n.edges[idx].node
+	common := longestCommonPrefix(search, child.prefix)
+	if common == len(child.prefix) {
+		newChild, updated := insertRadix(child, search[common:], key, value)
+		nc := n.clone()
+		nc.replaceEdge(idx, radixEdge{label: search[0], node: newChild})
+		return nc, updated
+	}
+
+	// The new key diverges partway through the existing edge: split it
+	// into a shared node holding the common prefix, with the old
+	// sub-tree and the new key as its two children.
+	split := &radixNode{prefix: search[:common]}
+	oldChild := child.clone()
+	oldChild.prefix = oldChild.prefix[common:]
+	split.addEdge(radixEdge{label: oldChild.prefix[0], node: oldChild})
+
+	if common == len(search) {
+		split.leaf = &radixLeaf{key: key, value: value}
+	} else {
+		split.addEdge(radixEdge{
+			label: search[common],
+			node:  &radixNode{prefix: search[common:], leaf: &radixLeaf{key: key, value: value}},
+		})
+	}
+
+	nc := n.clone()
+	nc.replaceEdge(idx, radixEdge{label: search[0], node: split})
+	return nc, false
+}
+
+// Delete returns a new tree with the association for key removed (or
+// the original tree if key didn't exist).
+func (m *RadixMap) Delete(key string) *RadixMap {
+	newRoot, deleted := deleteRadix(m.root, []byte(key), true)
+	if !deleted {
+		return m
+	}
+	return &RadixMap{root: newRoot, size: m.size - 1}
+}
+
+// deleteRadix removes the association for search from n, returning the
+// replacement node and whether anything was deleted.  isRoot must be
+// true only for the tree's root: every reader starts at the root and
+// expects root.prefix == "", so the root's own prefix is never allowed
+// to merge in a child's, even when it ends up with a single edge and no
+// leaf of its own.
+func deleteRadix(n *radixNode, search []byte, isRoot bool) (*radixNode, bool) {
+	if len(search) == 0 {
+		if n.leaf == nil {
+			return nil, false
+		}
+		nc := n.clone()
+		nc.leaf = nil
+		if !isRoot && len(nc.edges) == 1 {
+			nc = mergeRadixChild(nc)
+		}
+		return nc, true
+	}
+
+	idx, ok := n.getEdge(search[0])
+	if !ok || !bytes.HasPrefix(search, n.edges[idx].node.prefix) {
+		return nil, false
+	}
+
+	child := n.edges[idx].node
+	newChild, deleted := deleteRadix(child, search[len(child.prefix):], false)
+	if !deleted {
+		return nil, false
+	}
+
+	nc := n.clone()
+	if newChild.leaf == nil && len(newChild.edges) == 0 {
+		nc.delEdge(idx)
+		if !isRoot && nc.leaf == nil && len(nc.edges) == 1 {
+			nc = mergeRadixChild(nc)
+		}
+	} else {
+		nc.replaceEdge(idx, radixEdge{label: search[0], node: newChild})
+	}
+	return nc, true
+}
+
+// mergeRadixChild collapses n's single remaining child into n itself,
+// combining their prefixes.  Only called when n has no leaf of its own
+// and exactly one edge, the situation that leaves a needless extra hop
+// in the tree after a delete.
+func mergeRadixChild(n *radixNode) *radixNode {
+	child := n.edges[0].node
+	closeRadixMutateCh(child) // child's identity disappears into the merged node
+	prefix := make([]byte, 0, len(n.prefix)+len(child.prefix))
+	prefix = append(prefix, n.prefix...)
+	prefix = append(prefix, child.prefix...)
+	return &radixNode{
+		prefix: prefix,
+		leaf:   child.leaf,
+		edges:  child.edges,
+	}
+}
+
+// LongestPrefix finds the longest key in the tree that is a prefix of
+// the given key, returning that key, its value, and whether one was
+// found.  This is useful for routing-table style lookups (e.g. finding
+// the most specific matching rule for a path or CIDR).
+func (m *RadixMap) LongestPrefix(key string) (string, Any, bool) {
+	var last *radixLeaf
+	n := m.root
+	search := []byte(key)
+	for {
+		if n.leaf != nil {
+			last = n.leaf
+		}
+		if len(search) == 0 {
+			break
+		}
+		idx, ok := n.getEdge(search[0])
+		if !ok || !bytes.HasPrefix(search, n.edges[idx].node.prefix) {
+			break
+		}
+		n = n.edges[idx].node
+		search = search[len(n.prefix):]
+	}
+	if last == nil {
+		return "", nil, false
+	}
+	return last.key, last.value, true
+}
+
+// WalkPrefix calls fn for every key in the tree that has the given
+// prefix, in lexicographic order, stopping early if fn returns true.
+func (m *RadixMap) WalkPrefix(prefix string, fn func(key string, value Any) bool) {
+	n := m.root
+	search := []byte(prefix)
+	for {
+		if len(search) == 0 {
+			radixWalk(n, fn)
+			return
+		}
+
+		idx, ok := n.getEdge(search[0])
+		if !ok {
+			return
+		}
+		child := n.edges[idx].node
+
+		switch {
+		case bytes.HasPrefix(child.prefix, search):
+			// the whole rest of our search is a prefix of this edge, so
+			// everything below it qualifies
+			radixWalk(child, fn)
+			return
+		case bytes.HasPrefix(search, child.prefix):
+			search = search[len(child.prefix):]
+			n = child
+		default:
+			return
+		}
+	}
+}
+
+func radixWalk(n *radixNode, fn func(key string, value Any) bool) bool {
+	if n.leaf != nil && fn(n.leaf.key, n.leaf.value) {
+		return true
+	}
+	for _, e := range n.edges {
+		if radixWalk(e.node, fn) {
+			return true
+		}
+	}
+	return false
+}
+
+// WalkPath calls fn for every key in the tree that is a prefix of key
+// (including key itself, if present), in root-to-leaf order, stopping
+// early if fn returns true.  This is useful for hierarchical lookups,
+// e.g. checking successively more specific ACL rules on the way down to
+// a resource path.
+func (m *RadixMap) WalkPath(key string, fn func(key string, value Any) bool) {
+	n := m.root
+	search := []byte(key)
+	for {
+		if n.leaf != nil && fn(n.leaf.key, n.leaf.value) {
+			return
+		}
+		if len(search) == 0 {
+			return
+		}
+		idx, ok := n.getEdge(search[0])
+		if !ok || !bytes.HasPrefix(search, n.edges[idx].node.prefix) {
+			return
+		}
+		n = n.edges[idx].node
+		search = search[len(n.prefix):]
+	}
+}
+
+// ForEach calls f on every key/value pair in the tree, visiting keys in
+// lexicographic order.
+func (m *RadixMap) ForEach(f func(key string, value Any)) {
+	radixWalk(m.root, func(key string, value Any) bool {
+		f(key, value)
+		return false
+	})
+}
+
+// Keys returns a slice of every key in the tree, in lexicographic order.
+func (m *RadixMap) Keys() []string {
+	keys := make([]string, 0, m.size)
+	m.ForEach(func(k string, v Any) {
+		keys = append(keys, k)
+	})
+	return keys
+}
+
+func longestCommonPrefix(a, b []byte) int {
+	max := len(a)
+	if len(b) < max {
+		max = len(b)
+	}
+	i := 0
+	for i < max && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+// make it easier to display trees for debugging
+func (m *RadixMap) String() string {
+	buf := bytes.NewBufferString("{")
+	m.ForEach(func(key string, value Any) {
+		fmt.Fprintf(buf, "%s: %v, ", key, value)
+	})
+	fmt.Fprintf(buf, "}\n")
+	return buf.String()
+}
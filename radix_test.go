@@ -0,0 +1,202 @@
+package ps
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRadixMapGetInsert(t *testing.T) {
+	m := NewRadixMap()
+	m = m.Insert("foo", 1)
+	m = m.Insert("foobar", 2)
+	m = m.Insert("foobaz", 3)
+
+	cases := []struct {
+		key  string
+		want int
+		ok   bool
+	}{
+		{"foo", 1, true},
+		{"foobar", 2, true},
+		{"foobaz", 3, true},
+		{"fo", 0, false},
+		{"foob", 0, false},
+		{"other", 0, false},
+	}
+	for _, c := range cases {
+		got, ok := m.Get(c.key)
+		if ok != c.ok {
+			t.Errorf("Get(%q) ok = %v, want %v", c.key, ok, c.ok)
+			continue
+		}
+		if ok && got.(int) != c.want {
+			t.Errorf("Get(%q) = %v, want %v", c.key, got, c.want)
+		}
+	}
+	if m.Len() != 3 {
+		t.Errorf("Len() = %d, want 3", m.Len())
+	}
+}
+
+func TestRadixMapInsertUpdatesValueWithoutGrowingSize(t *testing.T) {
+	m := NewRadixMap().Insert("foo", 1)
+	m2 := m.Insert("foo", 2)
+
+	if m2.Len() != 1 {
+		t.Fatalf("Len() = %d, want 1", m2.Len())
+	}
+	v, _ := m2.Get("foo")
+	if v.(int) != 2 {
+		t.Fatalf("Get(foo) = %v, want 2", v)
+	}
+	// original map must be unaffected
+	v, _ = m.Get("foo")
+	if v.(int) != 1 {
+		t.Fatalf("original map was mutated: Get(foo) = %v, want 1", v)
+	}
+}
+
+func TestRadixMapDeleteMergesSingleChild(t *testing.T) {
+	m := NewRadixMap().Insert("foo", 1).Insert("foobar", 2)
+	m = m.Delete("foo")
+
+	if _, ok := m.Get("foo"); ok {
+		t.Fatalf("foo should have been deleted")
+	}
+	v, ok := m.Get("foobar")
+	if !ok || v.(int) != 2 {
+		t.Fatalf("Get(foobar) = %v, %v; want 2, true", v, ok)
+	}
+	if m.Len() != 1 {
+		t.Fatalf("Len() = %d, want 1", m.Len())
+	}
+}
+
+func TestRadixMapDeleteLeavesOriginalUntouched(t *testing.T) {
+	m := NewRadixMap().Insert("foo", 1).Insert("bar", 2)
+	m2 := m.Delete("foo")
+
+	if _, ok := m.Get("foo"); !ok {
+		t.Fatalf("original map should still have foo")
+	}
+	if _, ok := m2.Get("foo"); ok {
+		t.Fatalf("new map should not have foo")
+	}
+}
+
+func TestRadixMapDeleteOfTopLevelDivergentKeyKeepsRootIntact(t *testing.T) {
+	m := NewRadixMap().Insert("foo", 1).Insert("bar", 2)
+	m = m.Delete("bar")
+
+	if m.Len() != 1 {
+		t.Fatalf("Len() = %d, want 1", m.Len())
+	}
+	v, ok := m.Get("foo")
+	if !ok || v.(int) != 1 {
+		t.Fatalf("Get(foo) = %v, %v; want 1, true", v, ok)
+	}
+	got := m.Keys()
+	want := []string{"foo"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Keys() = %v, want %v", got, want)
+	}
+}
+
+func TestRadixMapLongestPrefix(t *testing.T) {
+	m := NewRadixMap().Insert("foo", 1).Insert("foo/bar", 2).Insert("foo/bar/baz", 3)
+
+	k, v, ok := m.LongestPrefix("foo/bar/baz/qux")
+	if !ok || k != "foo/bar/baz" || v.(int) != 3 {
+		t.Fatalf("LongestPrefix = %q, %v, %v; want foo/bar/baz, 3, true", k, v, ok)
+	}
+
+	k, v, ok = m.LongestPrefix("foo/quux")
+	if !ok || k != "foo" || v.(int) != 1 {
+		t.Fatalf("LongestPrefix = %q, %v, %v; want foo, 1, true", k, v, ok)
+	}
+
+	_, _, ok = m.LongestPrefix("nope")
+	if ok {
+		t.Fatalf("LongestPrefix(nope) should not match")
+	}
+}
+
+func TestRadixMapWalkPrefix(t *testing.T) {
+	m := NewRadixMap().Insert("foo", 1).Insert("foobar", 2).Insert("foobaz", 3).Insert("other", 4)
+
+	var got []string
+	m.WalkPrefix("foob", func(key string, value Any) bool {
+		got = append(got, key)
+		return false
+	})
+
+	want := []string{"foobar", "foobaz"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("WalkPrefix(foob) = %v, want %v", got, want)
+	}
+}
+
+func TestRadixMapWalkPath(t *testing.T) {
+	m := NewRadixMap().Insert("foo", 1).Insert("foo/bar", 2).Insert("foo/bar/baz", 3).Insert("foo/qux", 4)
+
+	var got []string
+	m.WalkPath("foo/bar/baz", func(key string, value Any) bool {
+		got = append(got, key)
+		return false
+	})
+
+	want := []string{"foo", "foo/bar", "foo/bar/baz"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("WalkPath(foo/bar/baz) = %v, want %v", got, want)
+	}
+}
+
+func TestRadixMapForEachIsLexicographic(t *testing.T) {
+	m := NewRadixMap()
+	for _, k := range []string{"banana", "apple", "cherry", "app", "b"} {
+		m = m.Insert(k, nil)
+	}
+
+	var got []string
+	m.ForEach(func(key string, value Any) {
+		got = append(got, key)
+	})
+
+	want := []string{"app", "apple", "b", "banana", "cherry"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("ForEach order = %v, want %v", got, want)
+	}
+}
+
+func TestRadixMapWatchPrefixFiresOnMutationUnderPrefix(t *testing.T) {
+	m := NewRadixMap().Insert("foo", 1).Insert("foobar", 2)
+	ch := m.WatchPrefix("foob")
+
+	m.Insert("foobaz", 3)
+
+	if !isClosed(ch) {
+		t.Fatalf("watch on prefix %q did not fire after inserting under it", "foob")
+	}
+}
+
+func TestRadixMapWatchPrefixNotWokenByUnrelatedPrefix(t *testing.T) {
+	m := NewRadixMap().Insert("foo", 1).Insert("foobar", 2).Insert("other", 3)
+	ch := m.WatchPrefix("foob")
+
+	m.Insert("other", 4)
+
+	if isClosed(ch) {
+		t.Fatalf("watch on prefix %q fired after an unrelated mutation", "foob")
+	}
+}
+
+func TestRadixMapWatchPrefixFiresOnDelete(t *testing.T) {
+	m := NewRadixMap().Insert("foo", 1).Insert("foobar", 2)
+	ch := m.WatchPrefix("foobar")
+
+	m.Delete("foobar")
+
+	if !isClosed(ch) {
+		t.Fatalf("watch on prefix %q did not fire after deleting it", "foobar")
+	}
+}
@@ -8,42 +8,63 @@ import (
 // String maps using explicit values instead of interfaces to
 // avoid unnecessary garbage/castings.
 
+// stringEntry is one extra key/value pair chained onto a node whose
+// hash collides with the node's own key.  Collisions between distinct
+// keys are rare with a good hash, so they're kept out of the common,
+// single-entry node shape and only paid for when they actually occur.
+type stringEntry struct {
+	key   string
+	value string
+}
+
 type StringMap struct {
 	count    int
 	hash     uint64 // hash of the key (used for tree balancing)
 	key      string
 	value    string
+	extra    []stringEntry // additional key/value pairs that hash-collide with key; nil in the common case
 	children [childCount]*StringMap
+	mutateCh chan struct{} // lazily created; closed when a Txn replaces this node
 }
 
 var nilStringMap = &StringMap{}
 
-// Recursively set nilMap's subtrees to point at itself.
+// Recursively set nilStringMap's subtrees to point at itself.
 // This eliminates all nil pointers in the map structure.
 // All map nodes are created by cloning this structure so
 // they avoid the problem too.
 func init() {
-	for i := range nilMap.children {
-		nilMap.children[i] = nilMap
+	for i := range nilStringMap.children {
+		nilStringMap.children[i] = nilStringMap
 	}
 }
 
-// NewMap allocates a new, persistent map from strings to values of
-// any type.
+// NewStringMap allocates a new, persistent map from strings to strings.
 // This is currently implemented as a path-copying binary tree.
 func NewStringMap() *StringMap {
-	return nilMap
+	return nilStringMap
 }
 
 func (self *StringMap) IsNil() bool {
-	return self == nilMap
+	return self == nilStringMap
 }
 
-// clone returns an exact duplicate of a tree node
+// clone returns an exact duplicate of a tree node, except for mutateCh:
+// the clone is a logically distinct node, so it starts with no watchers
+// of its own (self's watchers are notified separately when its
+// mutateCh is closed). mutateCh is deliberately left out of a wholesale
+// struct copy rather than copied-then-zeroed, since self may be a
+// published node whose mutateCh is concurrently closed by a Commit on
+// another Txn; reading it here without going through chMu would race.
 func (self *StringMap) clone() *StringMap {
-	var m StringMap
-	m = *self
-	return &m
+	return &StringMap{
+		count:    self.count,
+		hash:     self.hash,
+		key:      self.key,
+		value:    self.value,
+		extra:    self.extra,
+		children: self.children,
+	}
 }
 
 // Set returns a new map similar to this one but with key and value
@@ -51,12 +72,12 @@ func (self *StringMap) clone() *StringMap {
 // associated value is changed.
 func (self *StringMap) Set(key string, value string) Map {
 	hash := hashKey(key)
-	return self.setLowLevel(self, hash, hash, key, value)
+	return self.setLowLevel(nil, hash, hash, key, value)
 }
 
-func (self *StringMap) setLowLevel(partialHash, hash uint64, key string, value string) *StringMap {
+func (self *StringMap) setLowLevel(txn *stringTxnCache, partialHash, hash uint64, key string, value string) *StringMap {
 	if self.IsNil() { // an empty tree is easy
-		m := self.clone()
+		m := txn.cloneOf(self)
 		m.count = 1
 		m.hash = hash
 		m.key = key
@@ -65,25 +86,49 @@ func (self *StringMap) setLowLevel(partialHash, hash uint64, key string, value s
 	}
 
 	if hash != self.hash {
-		m := self.clone()
+		m := txn.cloneOf(self)
 		i := partialHash % childCount
-		m.children[i] = setLowLevel(self.children[i], partialHash>>shiftSize, hash, key, value)
-		recalculateCount(m)
+		m.children[i] = m.children[i].setLowLevel(txn, partialHash>>shiftSize, hash, key, value)
+		m.recalculateCount()
 		return m
 	}
 
-	// did we find a hash collision?
-	if key != self.key {
-		oops := fmt.Sprintf("Hash collision between: '%s' and '%s'.  Please report to https://github.com/mndrix/ps/issues/new", self.key, key)
-		panic(oops)
+	// same hash: either replacing this node's own key...
+	if key == self.key {
+		m := txn.cloneOf(self)
+		m.value = value
+		return m
 	}
 
-	// replacing a key's previous value
-	m := self.clone()
-	m.value = value
+	// ...or an existing member of its collision bucket...
+	for i, e := range self.extra {
+		if e.key == key {
+			m := txn.cloneOf(self)
+			newExtra := make([]stringEntry, len(m.extra))
+			copy(newExtra, m.extra)
+			newExtra[i].value = value
+			m.extra = newExtra
+			return m
+		}
+	}
+
+	// ...or a genuine collision: a new key sharing this node's hash.
+	m := txn.cloneOf(self)
+	newExtra := make([]stringEntry, len(m.extra)+1)
+	copy(newExtra, m.extra)
+	newExtra[len(m.extra)] = stringEntry{key, value}
+	m.extra = newExtra
+	m.count++
 	return m
 }
 
+// bucketSize returns the number of keys stored at this node itself
+// (its own key plus any collision-bucket entries), as opposed to keys
+// held by its children.
+func (m *StringMap) bucketSize() int {
+	return 1 + len(m.extra)
+}
+
 // modifies a map by recalculating its key count based on the counts
 // of its subtrees
 func (m *StringMap) recalculateCount() {
@@ -91,16 +136,16 @@ func (m *StringMap) recalculateCount() {
 	for _, t := range m.children {
 		count += t.Size()
 	}
-	m.count = count + 1 // add one to count ourself
+	m.count = count + m.bucketSize()
 }
 
 func (m *StringMap) Delete(key string) Map {
 	hash := hashKey(key)
-	newMap, _ := deleteLowLevel(m, hash, hash)
+	newMap, _ := m.deleteLowLevel(nil, hash, hash, key)
 	return newMap
 }
 
-func deleteLowLevel(self *StringMap, partialHash, hash uint64) (*StringMap, bool) {
+func (self *StringMap) deleteLowLevel(txn *stringTxnCache, partialHash, hash uint64, key string) (*StringMap, bool) {
 	// empty trees are easy
 	if self.IsNil() {
 		return self, false
@@ -108,30 +153,47 @@ func deleteLowLevel(self *StringMap, partialHash, hash uint64) (*StringMap, bool
 
 	if hash != self.hash {
 		i := partialHash % childCount
-		child, found := deleteLowLevel(self.children[i], partialHash>>shiftSize, hash)
+		child, found := self.children[i].deleteLowLevel(txn, partialHash>>shiftSize, hash, key)
 		if !found {
 			return self, false
 		}
-		newMap := self.clone()
+		newMap := txn.cloneOf(self)
 		newMap.children[i] = child
 		newMap.recalculateCount()
-		return newMap, true // ? this wasn't in the original code
+		return newMap, true
+	}
+
+	// same hash, but not our own key: look for it in the bucket
+	if key != self.key {
+		for i, e := range self.extra {
+			if e.key == key {
+				newMap := txn.cloneOf(self)
+				newExtra := make([]stringEntry, 0, len(self.extra)-1)
+				newExtra = append(newExtra, self.extra[:i]...)
+				newExtra = append(newExtra, self.extra[i+1:]...)
+				newMap.extra = newExtra
+				newMap.recalculateCount()
+				return newMap, true
+			}
+		}
+		return self, false
+	}
+
+	// deleting our own key: if the bucket has other members, the
+	// first of them takes over as this node's own key
+	if len(self.extra) > 0 {
+		newMap := txn.cloneOf(self)
+		newMap.key = self.extra[0].key
+		newMap.value = self.extra[0].value
+		newMap.extra = append([]stringEntry(nil), self.extra[1:]...)
+		newMap.recalculateCount()
+		return newMap, true
 	}
 
 	// we must delete our own node
 	if self.isLeaf() { // we have no children
-		return nilMap, true
-	}
-	/*
-	   if self.subtreeCount() == 1 { // only one subtree
-	       for _, t := range self.children {
-	           if t != nilMap {
-	               return t, true
-	           }
-	       }
-	       panic("Tree with 1 subtree actually had no subtrees")
-	   }
-	*/
+		return nilStringMap, true
+	}
 
 	// find a node to replace us
 	i := -1
@@ -144,8 +206,8 @@ func deleteLowLevel(self *StringMap, partialHash, hash uint64) (*StringMap, bool
 	}
 
 	// make chosen leaf smaller
-	replacement, child := self.children[i].deleteLeftmost()
-	newMap := replacement.clone()
+	replacement, child := self.children[i].deleteLeftmost(txn)
+	newMap := txn.cloneOf(replacement)
 	for j := range self.children {
 		if j == i {
 			newMap.children[j] = child
@@ -153,23 +215,27 @@ func deleteLowLevel(self *StringMap, partialHash, hash uint64) (*StringMap, bool
 			newMap.children[j] = self.children[j]
 		}
 	}
-	recalculateCount(newMap)
+	newMap.recalculateCount()
 	return newMap, true
 }
 
 // delete the leftmost node in a tree returning the node that
 // was deleted and the tree left over after its deletion
-func (m *StringMap) deleteLeftmost() (*StringMap, *StringMap) {
+func (m *StringMap) deleteLeftmost(txn *stringTxnCache) (*StringMap, *StringMap) {
 	if m.isLeaf() {
-		return m, nilMap
+		// A leaf's whole bucket - its own key plus any collision-chain
+		// entries - shares one hash, so it moves as a single unit; it
+		// can't be split between the promoted node and what's left
+		// behind without making part of it unreachable.
+		return m, nilStringMap
 	}
 
 	for i, t := range m.children {
-		if t != nilMap {
-			deleted, child := t.deleteLeftmost()
-			newMap := m.clone()
+		if t != nilStringMap {
+			deleted, child := t.deleteLeftmost(txn)
+			newMap := txn.cloneOf(m)
 			newMap.children[i] = child
-			recalculateCount(newMap)
+			newMap.recalculateCount()
 			return deleted, newMap
 		}
 	}
@@ -178,14 +244,14 @@ func (m *StringMap) deleteLeftmost() (*StringMap, *StringMap) {
 
 // isLeaf returns true if this is a leaf node
 func (m *StringMap) isLeaf() bool {
-	return m.Size() == 1
+	return m.subtreeCount() == 0
 }
 
 // returns the number of child subtrees we have
 func (m *StringMap) subtreeCount() int {
 	count := 0
 	for _, t := range m.children {
-		if t != nilMap {
+		if t != nilStringMap {
 			count++
 		}
 	}
@@ -194,21 +260,30 @@ func (m *StringMap) subtreeCount() int {
 
 func (m *StringMap) Lookup(key string) (string, bool) {
 	hash := hashKey(key)
-	return lookupLowLevel(m, hash, hash)
+	return m.lookupLowLevel(hash, hash, key)
 }
 
-func lookupLowLevel(self *StringMap, partialHash, hash uint64) (string, bool) {
+func (self *StringMap) lookupLowLevel(partialHash, hash uint64, key string) (string, bool) {
 	if self.IsNil() { // an empty tree is easy
-		return nil, false
+		return "", false
 	}
 
 	if hash != self.hash {
 		i := partialHash % childCount
-		return lookupLowLevel(self.children[i], partialHash>>shiftSize, hash)
+		return self.children[i].lookupLowLevel(partialHash>>shiftSize, hash, key)
 	}
 
-	// we found it
-	return self.value, true
+	// we found the right node; it may still take a bucket scan to find
+	// the right key
+	if key == self.key {
+		return self.value, true
+	}
+	for _, e := range self.extra {
+		if e.key == key {
+			return e.value, true
+		}
+	}
+	return "", false
 }
 
 func (m *StringMap) Size() int {
@@ -222,10 +297,13 @@ func (m *StringMap) ForEach(f func(key string, val string)) {
 
 	// ourself
 	f(m.key, m.value)
+	for _, e := range m.extra {
+		f(e.key, e.value)
+	}
 
 	// children
 	for _, t := range m.children {
-		if t != nilMap {
+		if t != nilStringMap {
 			t.ForEach(f)
 		}
 	}
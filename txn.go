@@ -0,0 +1,252 @@
+package ps
+
+// defaultTxnCacheLimit bounds how many original-node-to-mutable-clone
+// mappings a transaction keeps around at once.  It's sized generously
+// enough to cover the nodes near the root touched by a typical batch of
+// mutations without letting a pathological transaction (one that visits
+// millions of distinct nodes) grow the cache without bound.
+const defaultTxnCacheLimit = 8192
+
+// txnCache memoizes the mutable clone produced for each original *tree
+// node visited during a transaction, so that a node revisited later in
+// the same transaction (e.g. the root, visited by every Set/Delete) is
+// mutated in place instead of being path-copied again. It evicts the
+// oldest entry once full, which is good enough since the hottest nodes
+// (those nearest the root) are also the ones re-visited most often and
+// so get re-inserted, keeping them alive.
+//
+// The same map doubles as the set of original nodes whose watchers need
+// notifying once the transaction commits: a node only ends up here
+// because a mutable clone replaced it, which is exactly when its
+// mutateCh should be closed.
+type txnCache struct {
+	clones     map[*tree]*tree
+	mine       map[*tree]bool // clones already owned by this txn; mutate in place
+	order      []*tree
+	limit      int
+	overflowed bool // true once an evicted node's watchers may go unnotified
+}
+
+func newTxnCache(limit int) *txnCache {
+	return &txnCache{
+		clones: make(map[*tree]*tree),
+		mine:   make(map[*tree]bool),
+		limit:  limit,
+	}
+}
+
+// cloneOf returns a mutable clone of n that's safe for this transaction
+// to mutate in place.  If n is already one of this transaction's own
+// clones, it's returned as-is; if n was cloned earlier in the
+// transaction, the cached clone is reused; otherwise a fresh clone is
+// made and remembered.  A nil receiver means "no transaction in
+// progress" and always clones fresh, which keeps the non-transactional
+// Set/Delete path identical to before.
+func (c *txnCache) cloneOf(n *tree) *tree {
+	if c == nil || n == nilMap {
+		// nilMap is a single shared sentinel standing in for every empty
+		// position in every tree, so its pointer identity doesn't
+		// correspond to any one logical node; caching a clone of it
+		// would alias unrelated empty slots together.
+		return n.clone()
+	}
+	if c.mine[n] {
+		return n
+	}
+	if clone, ok := c.clones[n]; ok {
+		return clone
+	}
+	clone := n.clone()
+	if len(c.order) >= c.limit {
+		oldest := c.order[0]
+		c.order = c.order[1:]
+		chMu.Lock()
+		watched := oldest.mutateCh != nil
+		chMu.Unlock()
+		if watched {
+			c.overflowed = true
+		}
+		delete(c.mine, c.clones[oldest])
+		delete(c.clones, oldest)
+	}
+	c.clones[n] = clone
+	c.mine[clone] = true
+	c.order = append(c.order, n)
+	return clone
+}
+
+// closeWatchers closes the mutateCh of every original node this
+// transaction replaced, waking anyone watching a key or path affected by
+// the transaction.  origRoot is the root as it stood before any of this
+// transaction's Set/Delete calls ran; if the cache overflowed, its
+// channel is closed too as a conservative fallback for any node whose
+// own tracking was evicted.
+func (c *txnCache) closeWatchers(origRoot *tree) {
+	if c == nil {
+		return
+	}
+	for orig := range c.clones {
+		closeTreeMutateCh(orig)
+	}
+	if c.overflowed {
+		closeTreeMutateCh(origRoot)
+	}
+}
+
+// Txn batches multiple Set/Delete calls against a map returned by NewMap
+// and applies them without path-copying the nodes near the root on every
+// single call.  The zero value is not usable; obtain one by calling Txn
+// on that map.
+type Txn struct {
+	root     *tree
+	origRoot *tree
+	cache    *txnCache
+}
+
+// Txn starts a new transaction rooted at self.  self is never modified;
+// the transaction's mutations are only visible once Commit is called.
+func (self *tree) Txn() *Txn {
+	return &Txn{root: self, origRoot: self, cache: newTxnCache(defaultTxnCacheLimit)}
+}
+
+// Set behaves like the map's own Set, but reuses this transaction's node
+// cache.
+func (t *Txn) Set(key string, value Any) *Txn {
+	hash := hashKey(key)
+	t.root = t.root.setLowLevel(t.cache, hash, hash, key, value)
+	return t
+}
+
+// Delete behaves like the map's own Delete, but reuses this
+// transaction's node cache.
+func (t *Txn) Delete(key string) *Txn {
+	hash := hashKey(key)
+	newRoot, _ := t.root.deleteLowLevel(t.cache, hash, hash, key)
+	t.root = newRoot
+	return t
+}
+
+// Commit returns the Map reflecting every Set/Delete applied so far and
+// wakes any watcher whose key or watched path was affected.  The
+// transaction may continue to be used afterward; further mutations build
+// on top of the committed state.
+func (t *Txn) Commit() Map {
+	t.cache.closeWatchers(t.origRoot)
+	committed := t.root
+	// Reset the cache so that any further Set/Delete calls path-copy
+	// from the just-committed tree instead of mutating its now-published
+	// nodes in place.
+	t.origRoot = committed
+	t.cache = newTxnCache(defaultTxnCacheLimit)
+	return committed
+}
+
+// stringTxnCache is the StringMap analogue of txnCache.
+type stringTxnCache struct {
+	clones     map[*StringMap]*StringMap
+	mine       map[*StringMap]bool
+	order      []*StringMap
+	limit      int
+	overflowed bool
+}
+
+func newStringTxnCache(limit int) *stringTxnCache {
+	return &stringTxnCache{
+		clones: make(map[*StringMap]*StringMap),
+		mine:   make(map[*StringMap]bool),
+		limit:  limit,
+	}
+}
+
+func (c *stringTxnCache) cloneOf(n *StringMap) *StringMap {
+	if c == nil || n == nilStringMap {
+		// nilStringMap is a single shared sentinel standing in for every
+		// empty position in every tree, so its pointer identity doesn't
+		// correspond to any one logical node; caching a clone of it
+		// would alias unrelated empty slots together.
+		return n.clone()
+	}
+	if c.mine[n] {
+		return n
+	}
+	if clone, ok := c.clones[n]; ok {
+		return clone
+	}
+	clone := n.clone()
+	if len(c.order) >= c.limit {
+		oldest := c.order[0]
+		c.order = c.order[1:]
+		chMu.Lock()
+		watched := oldest.mutateCh != nil
+		chMu.Unlock()
+		if watched {
+			c.overflowed = true
+		}
+		delete(c.mine, c.clones[oldest])
+		delete(c.clones, oldest)
+	}
+	c.clones[n] = clone
+	c.mine[clone] = true
+	c.order = append(c.order, n)
+	return clone
+}
+
+func (c *stringTxnCache) closeWatchers(origRoot *StringMap) {
+	if c == nil {
+		return
+	}
+	for orig := range c.clones {
+		closeStringMapMutateCh(orig)
+	}
+	if c.overflowed {
+		closeStringMapMutateCh(origRoot)
+	}
+}
+
+// StringTxn batches multiple Set/Delete calls against a StringMap and
+// applies them without path-copying the nodes near the root on every
+// single call.  The zero value is not usable; obtain one with
+// StringMap.Txn().
+type StringTxn struct {
+	root     *StringMap
+	origRoot *StringMap
+	cache    *stringTxnCache
+}
+
+// Txn starts a new transaction rooted at self.  self is never modified;
+// the transaction's mutations are only visible once Commit is called.
+func (self *StringMap) Txn() *StringTxn {
+	return &StringTxn{root: self, origRoot: self, cache: newStringTxnCache(defaultTxnCacheLimit)}
+}
+
+// Set behaves like StringMap.Set, but reuses this transaction's node
+// cache.
+func (t *StringTxn) Set(key, value string) *StringTxn {
+	h := hashKey(key)
+	t.root = t.root.setLowLevel(t.cache, h, h, key, value)
+	return t
+}
+
+// Delete behaves like StringMap.Delete, but reuses this transaction's
+// node cache.
+func (t *StringTxn) Delete(key string) *StringTxn {
+	h := hashKey(key)
+	newRoot, _ := t.root.deleteLowLevel(t.cache, h, h, key)
+	t.root = newRoot
+	return t
+}
+
+// Commit returns the Map reflecting every Set/Delete applied so far and
+// wakes any watcher whose key or watched path was affected.  The
+// transaction may continue to be used afterward; further mutations build
+// on top of the committed state.
+func (t *StringTxn) Commit() Map {
+	t.cache.closeWatchers(t.origRoot)
+	committed := t.root
+	// Reset the cache so that any further Set/Delete calls path-copy
+	// from the just-committed tree instead of mutating its now-published
+	// nodes in place.
+	t.origRoot = committed
+	t.cache = newStringTxnCache(defaultTxnCacheLimit)
+	return committed
+}
@@ -0,0 +1,105 @@
+package ps
+
+import (
+	"strconv"
+	"testing"
+)
+
+func BenchmarkStringMapSetBulkLoad(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		m := NewStringMap()
+		for j := 0; j < 1000; j++ {
+			key := strconv.Itoa(j)
+			m = m.Set(key, key).(*StringMap)
+		}
+	}
+}
+
+func BenchmarkStringMapTxnBulkLoad(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		txn := NewStringMap().Txn()
+		for j := 0; j < 1000; j++ {
+			key := strconv.Itoa(j)
+			txn.Set(key, key)
+		}
+		_ = txn.Commit()
+	}
+}
+
+func BenchmarkMapSetBulkLoad(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		m := NewMap()
+		for j := 0; j < 1000; j++ {
+			key := strconv.Itoa(j)
+			m = m.Set(key, j).(*tree)
+		}
+	}
+}
+
+func BenchmarkMapTxnBulkLoad(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		txn := nilMap.Txn()
+		for j := 0; j < 1000; j++ {
+			key := strconv.Itoa(j)
+			txn.Set(key, j)
+		}
+		_ = txn.Commit()
+	}
+}
+
+func TestStringTxnMatchesSequentialSet(t *testing.T) {
+	seq := NewStringMap()
+	txn := NewStringMap().Txn()
+	for i := 0; i < 500; i++ {
+		key := strconv.Itoa(i)
+		seq = seq.Set(key, key).(*StringMap)
+		txn.Set(key, key)
+	}
+	committed := txn.Commit().(*StringMap)
+
+	if committed.Size() != seq.Size() {
+		t.Fatalf("Txn size %d, want %d", committed.Size(), seq.Size())
+	}
+	for i := 0; i < 500; i++ {
+		key := strconv.Itoa(i)
+		want, _ := seq.Lookup(key)
+		got, ok := committed.Lookup(key)
+		if !ok || got != want {
+			t.Errorf("Lookup(%q) = %q, %v; want %q", key, got, ok, want)
+		}
+	}
+}
+
+func TestStringTxnLeavesOriginalUntouched(t *testing.T) {
+	orig := NewStringMap().Set("a", "1").(*StringMap)
+
+	txn := orig.Txn()
+	txn.Set("a", "2")
+	txn.Set("b", "3")
+	txn.Commit()
+
+	if v, _ := orig.Lookup("a"); v != "1" {
+		t.Fatalf("original map was mutated: Lookup(a) = %q, want 1", v)
+	}
+	if orig.Size() != 1 {
+		t.Fatalf("original map size changed to %d, want 1", orig.Size())
+	}
+}
+
+func TestStringTxnDelete(t *testing.T) {
+	m := NewStringMap().Set("a", "1").(*StringMap).Set("b", "2").(*StringMap)
+
+	txn := m.Txn()
+	txn.Delete("a")
+	committed := txn.Commit().(*StringMap)
+
+	if _, ok := committed.Lookup("a"); ok {
+		t.Fatalf("key a should have been deleted")
+	}
+	if v, ok := committed.Lookup("b"); !ok || v != "2" {
+		t.Fatalf("key b should be unaffected, got %q, %v", v, ok)
+	}
+	if _, ok := m.Lookup("a"); !ok {
+		t.Fatalf("original map should still have key a")
+	}
+}
@@ -0,0 +1,208 @@
+package ps
+
+import (
+	"bytes"
+	"sync"
+)
+
+// chMu guards the lazy creation of every node's mutateCh. Contention is
+// expected to be negligible: it's only held for the instant it takes to
+// check and possibly allocate a channel, never while walking the tree.
+var chMu sync.Mutex
+
+// watchChan returns self's mutateCh, lazily creating it.  Every access
+// to mutateCh - here and in closeTreeMutateCh - goes through chMu, since
+// a concurrent Watch can race with a Commit closing the same channel.
+func (self *tree) watchChan() <-chan struct{} {
+	chMu.Lock()
+	defer chMu.Unlock()
+	if self.mutateCh == nil {
+		self.mutateCh = make(chan struct{})
+	}
+	return self.mutateCh
+}
+
+// closeTreeMutateCh closes n's mutateCh, if any, and clears the field
+// so it can't be closed twice: the same original node can be visited by
+// more than one Txn started from the same base map, and each of their
+// Commits calls this, so closing must be idempotent rather than relying
+// on every Commit seeing the channel as live exactly once.  Clearing the
+// field also means a later Watch on this (still-unmutated) node lazily
+// creates a fresh channel for its next mutation instead of immediately
+// reporting closed.
+func closeTreeMutateCh(n *tree) {
+	chMu.Lock()
+	defer chMu.Unlock()
+	if n.mutateCh != nil {
+		close(n.mutateCh)
+		n.mutateCh = nil
+	}
+}
+
+// Watch returns a channel that's closed the next time a Txn commits a
+// mutation affecting key's own node: a Set/Delete of key, or of any
+// other key whose hash collides with it, since they share a node (see
+// the collision bucket in tree.extra), or of any key stored below that
+// node, since path-copying replaces every node on the way down to the
+// changed key. A Set of an unrelated key whose node merely sits on the
+// path from the root to this one doesn't close it, because path-copying
+// stops at the changed key's node without touching the watched node
+// beneath it; a Delete of such a key can close it, since refilling the
+// emptied node may move the watched node up or path-copy it.
+// Watching a key that isn't present falls back to watching the root,
+// since any mutation might be the one that inserts it; the fallback is
+// conservative (it may wake for unrelated inserts too) but never misses.
+//
+// Watching an empty map returns a channel that never closes: an empty
+// map has no node of its own to attach a channel to (every empty map
+// shares the same sentinel), so there's nothing yet for a Txn to
+// replace.
+func (self *tree) Watch(key string) <-chan struct{} {
+	if self.IsNil() {
+		return make(chan struct{})
+	}
+	hash := hashKey(key)
+	return self.watchNode(self, hash, hash).watchChan()
+}
+
+func (self *tree) watchNode(root *tree, partialHash, hash uint64) *tree {
+	if self.IsNil() {
+		return root
+	}
+	if hash != self.hash {
+		i := partialHash % childCount
+		return self.children[i].watchNode(root, partialHash>>shiftSize, hash)
+	}
+	return self
+}
+
+// watchChan returns self's mutateCh, lazily creating it.  Every access
+// to mutateCh - here and in closeStringMapMutateCh - goes through chMu,
+// since a concurrent Watch can race with a Commit closing the same
+// channel.
+func (self *StringMap) watchChan() <-chan struct{} {
+	chMu.Lock()
+	defer chMu.Unlock()
+	if self.mutateCh == nil {
+		self.mutateCh = make(chan struct{})
+	}
+	return self.mutateCh
+}
+
+// closeStringMapMutateCh closes n's mutateCh, if any, and clears the
+// field so it can't be closed twice: the same original node can be
+// visited by more than one Txn started from the same base map, and each
+// of their Commits calls this, so closing must be idempotent rather than
+// relying on every Commit seeing the channel as live exactly once.
+// Clearing the field also means a later Watch on this (still-unmutated)
+// node lazily creates a fresh channel for its next mutation instead of
+// immediately reporting closed.
+func closeStringMapMutateCh(n *StringMap) {
+	chMu.Lock()
+	defer chMu.Unlock()
+	if n.mutateCh != nil {
+		close(n.mutateCh)
+		n.mutateCh = nil
+	}
+}
+
+// Watch returns a channel that's closed the next time a Txn commits a
+// mutation affecting key's own node: a Set/Delete of key, or of any
+// other key whose hash collides with it, since they share a node (see
+// the collision bucket in StringMap.extra), or of any key stored below
+// that node, since path-copying replaces every node on the way down to
+// the changed key. A Set of an unrelated key whose node merely sits on
+// the path from the root to this one doesn't close it, because
+// path-copying stops at the changed key's node without touching the
+// watched node beneath it; a Delete of such a key can close it, since
+// refilling the emptied node may move the watched node up or path-copy
+// it. Watching a key that isn't present falls back to watching the
+// root, since any mutation might be the one that inserts it; the
+// fallback is conservative (it may wake for unrelated inserts too) but
+// never misses.
+//
+// Watching an empty map returns a channel that never closes: an empty
+// map has no node of its own to attach a channel to (every empty map
+// shares the same sentinel), so there's nothing yet for a Txn to
+// replace.
+func (self *StringMap) Watch(key string) <-chan struct{} {
+	if self.IsNil() {
+		return make(chan struct{})
+	}
+	hash := hashKey(key)
+	return self.watchNode(self, hash, hash).watchChan()
+}
+
+func (self *StringMap) watchNode(root *StringMap, partialHash, hash uint64) *StringMap {
+	if self.IsNil() {
+		return root
+	}
+	if hash != self.hash {
+		i := partialHash % childCount
+		return self.children[i].watchNode(root, partialHash>>shiftSize, hash)
+	}
+	return self
+}
+
+// watchChan returns n's mutateCh, lazily creating it.  Every access to
+// mutateCh - here and in closeRadixMutateCh - goes through chMu, since a
+// concurrent WatchPrefix can race with an Insert/Delete closing the
+// same channel.
+func (n *radixNode) watchChan() <-chan struct{} {
+	chMu.Lock()
+	defer chMu.Unlock()
+	if n.mutateCh == nil {
+		n.mutateCh = make(chan struct{})
+	}
+	return n.mutateCh
+}
+
+// closeRadixMutateCh closes n's mutateCh, if any, and clears the field
+// so it can't be closed twice. RadixMap has no Txn to batch mutations
+// behind, so unlike closeTreeMutateCh/closeStringMapMutateCh this is
+// called directly from clone() (see radix.go) rather than from a
+// separate commit step.
+func closeRadixMutateCh(n *radixNode) {
+	chMu.Lock()
+	defer chMu.Unlock()
+	if n.mutateCh != nil {
+		close(n.mutateCh)
+		n.mutateCh = nil
+	}
+}
+
+// WatchPrefix returns a channel that's closed the next time an Insert or
+// Delete mutates a node within prefix's subtree. It attaches to the node
+// that most precisely covers prefix: if prefix runs out in the middle of
+// an edge, that edge's child, whose subtree holds exactly the keys with
+// this prefix; if prefix diverges from the tree entirely, WatchPrefix
+// falls back to the nearest ancestor actually present, which is
+// conservative (it may wake for a mutation to a sibling prefix too) but
+// never misses.
+func (m *RadixMap) WatchPrefix(prefix string) <-chan struct{} {
+	n := m.root
+	search := []byte(prefix)
+	for {
+		if len(search) == 0 {
+			return n.watchChan()
+		}
+
+		idx, ok := n.getEdge(search[0])
+		if !ok {
+			return n.watchChan()
+		}
+		child := n.edges[idx].node
+
+		switch {
+		case bytes.HasPrefix(child.prefix, search):
+			// prefix ends partway down (or exactly at) this edge, so
+			// child's subtree is exactly what prefix covers
+			return child.watchChan()
+		case bytes.HasPrefix(search, child.prefix):
+			search = search[len(child.prefix):]
+			n = child
+		default:
+			return n.watchChan()
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package ps
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	case <-time.After(10 * time.Millisecond):
+		return false
+	}
+}
+
+// findDivergentKeys returns two keys whose hashes land in different
+// top-level children, so mutating one can never touch the other's path.
+func findDivergentKeys(m *StringMap) (string, string) {
+	first := strconv.Itoa(0)
+	firstIdx := hashKey(first) % childCount
+	for i := 1; i < 10000; i++ {
+		key := strconv.Itoa(i)
+		if hashKey(key)%childCount != firstIdx {
+			return first, key
+		}
+	}
+	panic("couldn't find two keys with divergent top-level hash buckets")
+}
+
+func TestStringMapWatchUnrelatedSubtreeNotWoken(t *testing.T) {
+	watched, other := findDivergentKeys(NewStringMap())
+
+	// Seed an unrelated "anchor" key first so neither watched nor other
+	// becomes the root node: the root is cloned on every mutation
+	// regardless of which key changed, which would make the test
+	// vacuous if watched ended up there.
+	m := NewStringMap().Set("anchor", "0").(*StringMap)
+	m = m.Set(watched, "1").(*StringMap).Set(other, "1").(*StringMap)
+	ch := m.Watch(watched)
+
+	txn := m.Txn()
+	txn.Set(other, "2")
+	txn.Commit()
+
+	if isClosed(ch) {
+		t.Fatalf("watch on %q fired after an unrelated mutation to %q", watched, other)
+	}
+}
+
+func TestStringMapWatchSurvivesTwoCommitsFromSharedBase(t *testing.T) {
+	watched, _ := findDivergentKeys(NewStringMap())
+
+	m := NewStringMap().Set("anchor", "0").(*StringMap).Set(watched, "1").(*StringMap)
+	ch1 := m.Watch(watched)
+
+	// Two independent Txns rooted at the same base map both replace
+	// watched's node on Commit; closing its mutateCh must not panic the
+	// second time just because the first already closed it.
+	m.Txn().Set(watched, "2").Commit()
+	if !isClosed(ch1) {
+		t.Fatalf("watch on %q did not fire after first commit", watched)
+	}
+
+	ch2 := m.Watch(watched)
+	m.Txn().Set(watched, "3").Commit()
+	if !isClosed(ch2) {
+		t.Fatalf("watch on %q did not fire after second commit", watched)
+	}
+}
+
+func TestMapWatchSurvivesTwoCommitsFromSharedBase(t *testing.T) {
+	m := nilMap.Set("anchor", 0).(*tree).Set("a", 1).(*tree)
+	ch1 := m.Watch("a")
+
+	m.Txn().Set("a", 2).Commit()
+	if !isClosed(ch1) {
+		t.Fatalf("watch on a did not fire after first commit")
+	}
+
+	ch2 := m.Watch("a")
+	m.Txn().Set("a", 3).Commit()
+	if !isClosed(ch2) {
+		t.Fatalf("watch on a did not fire after second commit")
+	}
+}
+
+func TestStringMapWatchFiresOnOwnKeyMutation(t *testing.T) {
+	watched, _ := findDivergentKeys(NewStringMap())
+
+	m := NewStringMap().Set("anchor", "0").(*StringMap).Set(watched, "1").(*StringMap)
+	ch := m.Watch(watched)
+
+	txn := m.Txn()
+	txn.Set(watched, "2")
+	txn.Commit()
+
+	if !isClosed(ch) {
+		t.Fatalf("watch on %q did not fire after mutating it", watched)
+	}
+}
+
+// TestStringMapWatchConcurrentWithCommit exercises the intended
+// concurrent use of the watch API - one goroutine calling Watch while
+// another commits Txns over the same nodes - under the race detector.
+func TestStringMapWatchConcurrentWithCommit(t *testing.T) {
+	m := NewStringMap()
+	for i := 0; i < 50; i++ {
+		m = m.Set(strconv.Itoa(i), "0").(*StringMap)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				m.Watch(strconv.Itoa(j))
+			}
+		}()
+		go func(i int) {
+			defer wg.Done()
+			txn := m.Txn()
+			for j := 0; j < 50; j++ {
+				txn.Set(strconv.Itoa(j), strconv.Itoa(i))
+			}
+			txn.Commit()
+		}(i)
+	}
+	wg.Wait()
+}